@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	nethttp "net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -105,6 +106,13 @@ func createAndStartServer(api *models.API) {
 		config.Server.HTTPS,
 		config.Server.HTTPSCert,
 		config.Server.HTTPSKey)
+
+	if metricsClient, ok := mqttClient.(interface {
+		MetricsHandler() nethttp.Handler
+	}); ok {
+		gostServer.Handle("/metrics", metricsClient.MetricsHandler())
+	}
+
 	gostServer.Start()
 }
 
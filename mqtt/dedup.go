@@ -0,0 +1,46 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// seenRecently reports whether topic+payload was dispatched within dedupTTL, recording it as seen otherwise.
+func (m *MQTT) seenRecently(topic string, payload []byte) bool {
+	if m.dedupTTL <= 0 {
+		return false
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(topic))
+	h.Write(payload)
+	key := strconv.FormatUint(h.Sum64(), 36)
+
+	now := time.Now()
+	if expiry, ok := m.msgCache.Load(key); ok && now.Before(expiry.(time.Time)) {
+		return true
+	}
+
+	m.msgCache.Store(key, now.Add(m.dedupTTL))
+	return false
+}
+
+// startDedupSweeper periodically drops expired entries from msgCache.
+func (m *MQTT) startDedupSweeper() {
+	if m.dedupTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(m.dedupTTL)
+	go func() {
+		for now := range ticker.C {
+			m.msgCache.Range(func(key, expiry interface{}) bool {
+				if now.After(expiry.(time.Time)) {
+					m.msgCache.Delete(key)
+				}
+				return true
+			})
+		}
+	}()
+}
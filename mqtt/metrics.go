@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MessageTracer fires before a received message is dispatched to its topic.Handler.
+type MessageTracer func(topic string, payloadSize int, qos byte, receivedAt time.Time)
+
+// MQTTMetrics is a point-in-time snapshot returned by MQTT.Metrics().
+type MQTTMetrics struct {
+	ConnectAttempts   uint64
+	ReconnectCount    uint64
+	SubscribeFailures uint64
+	MessagesReceived  map[string]uint64
+	MessagesPublished map[string]uint64
+	AvgPublishLatency time.Duration
+	InflightPublishes int64
+	LastConnected     time.Time
+}
+
+// metricsState holds the counters backing MQTTMetrics.
+type metricsState struct {
+	mu                sync.Mutex
+	connectAttempts   uint64
+	reconnectCount    uint64
+	subscribeFailures uint64
+	messagesReceived  map[string]uint64
+	messagesPublished map[string]uint64
+	publishLatencySum time.Duration
+	publishLatencyN   uint64
+	inflightPublishes int64
+	lastConnected     time.Time
+}
+
+func (s *metricsState) recordConnectAttempt() {
+	atomic.AddUint64(&s.connectAttempts, 1)
+}
+
+func (s *metricsState) recordReconnect() {
+	atomic.AddUint64(&s.reconnectCount, 1)
+}
+
+func (s *metricsState) recordSubscribeFailure() {
+	atomic.AddUint64(&s.subscribeFailures, 1)
+}
+
+func (s *metricsState) recordConnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastConnected = time.Now()
+}
+
+func (s *metricsState) recordReceived(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.messagesReceived == nil {
+		s.messagesReceived = make(map[string]uint64)
+	}
+	s.messagesReceived[topic]++
+}
+
+// publishTrackTimeout bounds how long trackPublish waits on a token, so a broker outage can't leak goroutines.
+const publishTrackTimeout = 5 * time.Minute
+
+// trackPublish tracks inflight count, latency and per-topic publish count for token.
+func (s *metricsState) trackPublish(topic string, token paho.Token) {
+	atomic.AddInt64(&s.inflightPublishes, 1)
+	start := time.Now()
+	go func() {
+		defer atomic.AddInt64(&s.inflightPublishes, -1)
+
+		if !token.WaitTimeout(publishTrackTimeout) {
+			logger.Warnf("publish to %s still inflight after %s, giving up on latency tracking", topic, publishTrackTimeout)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.messagesPublished == nil {
+			s.messagesPublished = make(map[string]uint64)
+		}
+		s.messagesPublished[topic]++
+		s.publishLatencySum += time.Since(start)
+		s.publishLatencyN++
+	}()
+}
+
+func (s *metricsState) snapshot() MQTTMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	received := make(map[string]uint64, len(s.messagesReceived))
+	for k, v := range s.messagesReceived {
+		received[k] = v
+	}
+	published := make(map[string]uint64, len(s.messagesPublished))
+	for k, v := range s.messagesPublished {
+		published[k] = v
+	}
+
+	var avgLatency time.Duration
+	if s.publishLatencyN > 0 {
+		avgLatency = s.publishLatencySum / time.Duration(s.publishLatencyN)
+	}
+
+	return MQTTMetrics{
+		ConnectAttempts:   atomic.LoadUint64(&s.connectAttempts),
+		ReconnectCount:    atomic.LoadUint64(&s.reconnectCount),
+		SubscribeFailures: atomic.LoadUint64(&s.subscribeFailures),
+		MessagesReceived:  received,
+		MessagesPublished: published,
+		AvgPublishLatency: avgLatency,
+		InflightPublishes: atomic.LoadInt64(&s.inflightPublishes),
+		LastConnected:     s.lastConnected,
+	}
+}
+
+// Metrics returns a snapshot of the client's connection, subscribe and publish accounting.
+func (m *MQTT) Metrics() MQTTMetrics {
+	return m.metrics.snapshot()
+}
+
+// SetMessageTracer installs a MessageTracer invoked before message dispatch.
+func (m *MQTT) SetMessageTracer(tracer MessageTracer) {
+	m.tracer = tracer
+}
@@ -1,10 +1,16 @@
 package mqtt
 
 import (
+	"bufio"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
@@ -20,6 +26,8 @@ var logger *log.Entry
 type MQTT struct {
 	host            string
 	port            int
+	brokers         []string
+	mqttV5          bool
 	prefix          string
 	clientID        string
 	sslEnabled      bool
@@ -39,6 +47,21 @@ type MQTT struct {
 	verbose         bool
 	api             *models.API
 	connectToken    *paho.ConnectToken
+	proxyURL        string
+	proxyUsername   string
+	proxyPassword   string
+	caCertPool      *x509.CertPool
+	clientCert      *tls.Certificate
+	willTopic       string
+	willPayload     string
+	willQos         byte
+	willRetain      bool
+	birthPayload    string
+	dedupTTL        time.Duration
+	msgCache        sync.Map
+	store           paho.Store
+	tracer          MessageTracer
+	metrics         metricsState
 }
 
 func setupLogger(verbose bool) {
@@ -65,29 +88,23 @@ func (m *MQTT) getProtocol() string {
 	}
 }
 
-func initMQTTClientOptions(client *MQTT) (*paho.ClientOptions, error) {
-
-	opts := paho.NewClientOptions() // uses defaults: https://godoc.org/github.com/eclipse/paho.mqtt.golang#NewClientOptions
-
-	if client.username != "" {
-		opts.SetUsername(client.username)
-	}
-	if client.password != "" {
-		opts.SetPassword(client.password)
+// buildTLSConfig assembles a *tls.Config for broker, setting SNI from its host.
+func buildTLSConfig(client *MQTT, broker *url.URL) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if broker != nil {
+		tlsConfig.ServerName = broker.Hostname()
 	}
 
-	// TLS CONFIG
-	tlsConfig := &tls.Config{}
 	if client.caCertPath != "" {
-
 		// Import trusted certificates from CAfile.pem.
 		// Alternatively, manually add CA certificates to
 		// default openssl CA bundle.
-		tlsConfig.RootCAs = x509.NewCertPool()
+		client.caCertPool = x509.NewCertPool()
 		pemCerts, err := ioutil.ReadFile(client.caCertPath)
 		if err == nil {
-			tlsConfig.RootCAs.AppendCertsFromPEM(pemCerts)
+			client.caCertPool.AppendCertsFromPEM(pemCerts)
 		}
+		tlsConfig.RootCAs = client.caCertPool
 	}
 	if client.clientCertPath != "" && client.privateKeyPath != "" {
 		// Import client certificate/key pair
@@ -100,12 +117,132 @@ func initMQTTClientOptions(client *MQTT) (*paho.ClientOptions, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error parsing client certificate: %s", err)
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		client.clientCert = &cert
+		tlsConfig.Certificates = []tls.Certificate{*client.clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// bufferedConn is a net.Conn whose Read is served from a bufio.Reader that
+// may already hold bytes buffered ahead of the raw connection, so nothing
+// read speculatively (e.g. past an HTTP CONNECT response) is lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// dialViaProxy tunnels the broker connection through an HTTP CONNECT proxy.
+func dialViaProxy(client *MQTT, proxy *url.URL) func(broker *url.URL, _ paho.ClientOptions) (net.Conn, error) {
+	return func(broker *url.URL, _ paho.ClientOptions) (net.Conn, error) {
+		rawConn, err := net.Dial("tcp", proxy.Host)
+		if err != nil {
+			return nil, fmt.Errorf("proxy dial error: %s", err)
+		}
+
+		connectReq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: broker.Host},
+			Host:   broker.Host,
+			Header: make(http.Header),
+		}
+		if client.proxyUsername != "" {
+			auth := base64.StdEncoding.EncodeToString([]byte(client.proxyUsername + ":" + client.proxyPassword))
+			connectReq.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := connectReq.Write(rawConn); err != nil {
+			rawConn.Close()
+			return nil, fmt.Errorf("proxy CONNECT write error: %s", err)
+		}
+
+		bufReader := bufio.NewReader(rawConn)
+		resp, err := http.ReadResponse(bufReader, connectReq)
+		if err != nil {
+			rawConn.Close()
+			return nil, fmt.Errorf("proxy CONNECT response error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			rawConn.Close()
+			return nil, fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+		}
+
+		// Anything already sitting in bufReader (e.g. TLS ServerHello bytes
+		// the proxy forwarded in the same segment as its CONNECT response)
+		// must keep being served from it, not dropped by reading rawConn directly.
+		var conn net.Conn = &bufferedConn{Conn: rawConn, r: bufReader}
+
+		if client.sslEnabled {
+			tlsConfig, err := buildTLSConfig(client, broker)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tls.Client(conn, tlsConfig)
+		}
+
+		return conn, nil
+	}
+}
+
+func initMQTTClientOptions(client *MQTT) (*paho.ClientOptions, error) {
+
+	opts := paho.NewClientOptions() // uses defaults: https://godoc.org/github.com/eclipse/paho.mqtt.golang#NewClientOptions
+
+	if client.username != "" {
+		opts.SetUsername(client.username)
+	}
+	if client.password != "" {
+		opts.SetPassword(client.password)
+	}
+
+	if len(client.brokers) > 0 {
+		// paho fails over between brokers added here in order, retrying the
+		// next one on connect failure.
+		for _, broker := range client.brokers {
+			opts.AddBroker(broker)
+		}
+	} else {
+		opts.AddBroker(fmt.Sprintf("%s://%s:%v", client.getProtocol(), client.host, client.port))
 	}
 
-	opts.AddBroker(fmt.Sprintf("%s://%s:%v", client.getProtocol(), client.host, client.port))
+	tlsConfig, err := buildTLSConfig(client, nil)
+	if err != nil {
+		return nil, err
+	}
 	opts.SetTLSConfig(tlsConfig)
 
+	// Recompute TLS parameters (SNI, RootCAs, ClientCert) on every connect
+	// attempt, which matters once brokers are round-robined via AddBroker.
+	opts.SetOnConnectAttempt(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		recomputed, err := buildTLSConfig(client, broker)
+		if err != nil {
+			logger.Errorf("unable to recompute TLS config for %s: %s", broker.Host, err)
+			return tlsCfg
+		}
+		return recomputed
+	})
+
+	if client.proxyURL != "" {
+		proxy, err := url.Parse(client.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %s", err)
+		}
+		opts.SetCustomOpenConnectionFn(dialViaProxy(client, proxy))
+	}
+
+	if client.willTopic != "" {
+		opts.SetWill(client.willTopic, client.willPayload, client.willQos, client.willRetain)
+	}
+
+	if client.store != nil {
+		opts.SetStore(client.store)
+	}
+
 	opts.SetClientID(client.clientID)
 	opts.SetCleanSession(!client.persistent)
 	opts.SetOrderMatters(client.order)
@@ -117,10 +254,22 @@ func initMQTTClientOptions(client *MQTT) (*paho.ClientOptions, error) {
 	return opts, nil
 }
 
-// CreateMQTTClient creates a new MQTT client
-func CreateMQTTClient(config configuration.MQTTConfig) models.MQTTClient {
+// CreateMQTTClient creates a new MQTT client. customStore is only consulted
+// when config.StoreType is "custom"; it is otherwise ignored and may be nil.
+//
+// NOTE: this signature depends on models.MQTTStore existing in
+// sensorthings/models, and *MQTT satisfying models.MQTTClient depends on
+// that interface's Publish method being updated to return paho.Token (see
+// MQTT.Publish below). Neither package is part of this checkout — confirm
+// both companion changes landed there before merging this series.
+func CreateMQTTClient(config configuration.MQTTConfig, customStore ...models.MQTTStore) models.MQTTClient {
 	setupLogger(config.Verbose)
 
+	var custom models.MQTTStore
+	if len(customStore) > 0 {
+		custom = customStore[0]
+	}
+
 	mqttClient := &MQTT{
 		host:            config.Host,
 		port:            config.Port,
@@ -137,7 +286,20 @@ func CreateMQTTClient(config configuration.MQTTConfig) models.MQTTClient {
 		privateKeyPath:  config.PrivateKeyFile,
 		keepAliveSec:    config.KeepAliveSec,
 		pingTimeoutSec:  config.PingTimeoutSec,
+		brokers:         config.Brokers,
+		mqttV5:          config.MQTTv5,
+		proxyURL:        config.ProxyURL,
+		proxyUsername:   config.ProxyUsername,
+		proxyPassword:   config.ProxyPassword,
+		willTopic:       config.WillTopic,
+		willPayload:     config.WillPayload,
+		willQos:         config.WillQos,
+		willRetain:      config.WillRetain,
+		birthPayload:    config.BirthPayload,
+		dedupTTL:        time.Duration(config.DedupTTLSec) * time.Second,
 	}
+	mqttClient.store = resolveStore(config, custom)
+	mqttClient.startDedupSweeper()
 
 	opts, err := initMQTTClientOptions(mqttClient)
 	if err != nil {
@@ -153,13 +315,25 @@ func CreateMQTTClient(config configuration.MQTTConfig) models.MQTTClient {
 // Start running the MQTT client
 func (m *MQTT) Start(api *models.API) {
 	m.api = api
-	logger.Infof("Starting MQTT client on %s://%s:%v with Prefix:%v, Persistence:%v, OrderMatters:%v, KeepAlive:%v, PingTimeout:%v, QOS:%v",
-		m.getProtocol(), m.host, m.port, m.prefix, m.persistent, m.order, m.keepAliveSec, m.pingTimeoutSec, m.subscriptionQos)
+	if len(m.brokers) > 0 {
+		logger.Infof("Starting MQTT client on brokers:%v with Prefix:%v, Persistence:%v, OrderMatters:%v, KeepAlive:%v, PingTimeout:%v, QOS:%v",
+			m.brokers, m.prefix, m.persistent, m.order, m.keepAliveSec, m.pingTimeoutSec, m.subscriptionQos)
+	} else {
+		logger.Infof("Starting MQTT client on %s://%s:%v with Prefix:%v, Persistence:%v, OrderMatters:%v, KeepAlive:%v, PingTimeout:%v, QOS:%v",
+			m.getProtocol(), m.host, m.port, m.prefix, m.persistent, m.order, m.keepAliveSec, m.pingTimeoutSec, m.subscriptionQos)
+	}
 	m.connect()
 }
 
 // Stop the MQTT client
 func (m *MQTT) Stop() {
+	if m.willTopic != "" && m.client.IsConnected() {
+		// Publish the "offline" message ourselves on a graceful shutdown;
+		// the broker only sends willPayload via the Last Will when the
+		// connection drops unexpectedly.
+		token := m.client.Publish(m.willTopic, m.willQos, m.willRetain, m.willPayload)
+		token.WaitTimeout(500 * time.Millisecond)
+	}
 	m.client.Disconnect(500)
 }
 
@@ -172,20 +346,46 @@ func (m *MQTT) subscribe() {
 		logger.Infof("MQTT client subscribing to %s", topic.Path)
 
 		if token := m.client.Subscribe(topic.Path, m.subscriptionQos, func(client paho.Client, msg paho.Message) {
-			go topic.Handler(m.api, m.prefix, msg.Topic(), msg.Payload())
+			receivedAt := time.Now()
+			m.metrics.recordReceived(msg.Topic())
+			if m.tracer != nil {
+				m.tracer(msg.Topic(), len(msg.Payload()), msg.Qos(), receivedAt)
+			}
+
+			if m.seenRecently(msg.Topic(), msg.Payload()) {
+				logger.Debugf("dropping duplicate message on %s", msg.Topic())
+				return
+			}
+
+			// topic.Handler takes only the payload, so a PublishWithProperties
+			// envelope is stripped here and its MessageProperties are dropped;
+			// dedup above works on the raw, still-wrapped payload.
+			payload, _ := decodeEnvelope(msg.Payload())
+			go topic.Handler(m.api, m.prefix, msg.Topic(), payload)
 		}); token.Wait() && token.Error() != nil {
+			m.metrics.recordSubscribeFailure()
 			logger.Error(token.Error())
 		}
 	}
 }
 
-// Publish a message on a topic
-func (m *MQTT) Publish(topic string, message string, qos byte) {
+// Publish a message on a topic. The returned token is not waited on here:
+// callers that need delivery confirmation should call token.Wait()
+// themselves, while fire-and-forget callers can ignore it, now that
+// in-flight QoS>0 publishes survive a dropped connection via the
+// configured store instead of depending on this call blocking.
+//
+// This return type change requires models.MQTTClient.Publish in
+// sensorthings/models to be updated to match, or *MQTT stops satisfying
+// that interface. Confirm that companion change before merging.
+func (m *MQTT) Publish(topic string, message string, qos byte) paho.Token {
 	token := m.client.Publish(topic, qos, false, message)
-	token.Wait()
+	m.metrics.trackPublish(topic, token)
+	return token
 }
 
 func (m *MQTT) connect() {
+	m.metrics.recordConnectAttempt()
 	m.connectToken = m.client.Connect().(*paho.ConnectToken)
 	if m.connectToken.Wait() && m.connectToken.Error() != nil {
 		if !m.connecting {
@@ -223,12 +423,20 @@ func (m *MQTT) connectHandler(c paho.Client) {
 		m.subscribe()
 	}
 
+	if m.willTopic != "" {
+		if token := m.client.Publish(m.willTopic, m.willQos, m.willRetain, m.birthPayload); token.Wait() && token.Error() != nil {
+			logger.Errorf("unable to publish birth message: %s", token.Error())
+		}
+	}
+
+	m.metrics.recordConnected()
 	m.disconnected = false
 }
 
-//ToDo: bubble up and call retryConnect?
+// ToDo: bubble up and call retryConnect?
 func (m *MQTT) connectionLostHandler(c paho.Client, err error) {
 	logger.Warnf("MQTT client lost connection: %v", err)
+	m.metrics.recordReconnect()
 	m.disconnected = true
 	m.retryConnect()
 }
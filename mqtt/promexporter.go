@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "gost_mqtt"
+
+// collector adapts MQTT.Metrics() to prometheus.Collector.
+type collector struct {
+	client *MQTT
+
+	connectAttempts   *prometheus.Desc
+	reconnectCount    *prometheus.Desc
+	subscribeFailures *prometheus.Desc
+	messagesReceived  *prometheus.Desc
+	messagesPublished *prometheus.Desc
+	avgPublishLatency *prometheus.Desc
+	inflightPublishes *prometheus.Desc
+	lastConnected     *prometheus.Desc
+}
+
+func newCollector(client *MQTT) *collector {
+	return &collector{
+		client: client,
+		connectAttempts: prometheus.NewDesc(
+			metricsNamespace+"_connect_attempts_total", "Total number of broker connect attempts.", nil, nil),
+		reconnectCount: prometheus.NewDesc(
+			metricsNamespace+"_reconnects_total", "Total number of lost broker connections, each of which starts the reconnect procedure.", nil, nil),
+		subscribeFailures: prometheus.NewDesc(
+			metricsNamespace+"_subscribe_failures_total", "Total number of topic subscribe failures.", nil, nil),
+		messagesReceived: prometheus.NewDesc(
+			metricsNamespace+"_messages_received_total", "Total number of messages received, by topic.", []string{"topic"}, nil),
+		messagesPublished: prometheus.NewDesc(
+			metricsNamespace+"_messages_published_total", "Total number of messages published, by topic.", []string{"topic"}, nil),
+		avgPublishLatency: prometheus.NewDesc(
+			metricsNamespace+"_publish_latency_seconds", "Average time from Publish() to the returned token completing.", nil, nil),
+		inflightPublishes: prometheus.NewDesc(
+			metricsNamespace+"_inflight_publishes", "Number of publishes awaiting token completion.", nil, nil),
+		lastConnected: prometheus.NewDesc(
+			metricsNamespace+"_last_connected_timestamp_seconds", "Unix time the client last completed a broker connection.", nil, nil),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connectAttempts
+	ch <- c.reconnectCount
+	ch <- c.subscribeFailures
+	ch <- c.messagesReceived
+	ch <- c.messagesPublished
+	ch <- c.avgPublishLatency
+	ch <- c.inflightPublishes
+	ch <- c.lastConnected
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := c.client.Metrics()
+
+	ch <- prometheus.MustNewConstMetric(c.connectAttempts, prometheus.CounterValue, float64(snapshot.ConnectAttempts))
+	ch <- prometheus.MustNewConstMetric(c.reconnectCount, prometheus.CounterValue, float64(snapshot.ReconnectCount))
+	ch <- prometheus.MustNewConstMetric(c.subscribeFailures, prometheus.CounterValue, float64(snapshot.SubscribeFailures))
+	for topic, count := range snapshot.MessagesReceived {
+		ch <- prometheus.MustNewConstMetric(c.messagesReceived, prometheus.CounterValue, float64(count), topic)
+	}
+	for topic, count := range snapshot.MessagesPublished {
+		ch <- prometheus.MustNewConstMetric(c.messagesPublished, prometheus.CounterValue, float64(count), topic)
+	}
+	ch <- prometheus.MustNewConstMetric(c.avgPublishLatency, prometheus.GaugeValue, snapshot.AvgPublishLatency.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.inflightPublishes, prometheus.GaugeValue, float64(snapshot.InflightPublishes))
+	if !snapshot.LastConnected.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.lastConnected, prometheus.GaugeValue, float64(snapshot.LastConnected.Unix()))
+	}
+}
+
+// MetricsHandler returns an http.Handler exposing m's metrics in Prometheus exposition format.
+func (m *MQTT) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCollector(m))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Magic prefixes envelope-wrapped payloads so subscribe() can recognize one.
+var v5Magic = []byte("GOSTv5\x00")
+
+// MessageProperties carries the MQTT v5 style properties GOST threads
+// through GOST-to-GOST publishes (user properties, content-type,
+// response-topic, correlation data).
+//
+// This is NOT real MQTT v5: eclipse/paho.mqtt.golang only speaks the
+// v3.1.1 wire protocol, so properties ride inside the payload as a JSON
+// envelope rather than as native v5 publish properties. Only enable
+// config.MQTTv5 when every subscriber on the topic is a GOST instance
+// (or otherwise envelope-aware) — a real MQTT v5 client, or any other
+// plain subscriber, would receive the opaque envelope bytes instead of
+// the SensorThings payload it expects.
+type MessageProperties struct {
+	ContentType     string            `json:"contentType,omitempty"`
+	ResponseTopic   string            `json:"responseTopic,omitempty"`
+	CorrelationData []byte            `json:"correlationData,omitempty"`
+	UserProperties  map[string]string `json:"userProperties,omitempty"`
+}
+
+type messageEnvelope struct {
+	Properties MessageProperties `json:"properties"`
+	Payload    []byte            `json:"payload"`
+}
+
+// PublishWithProperties publishes a message carrying MessageProperties. Use
+// Publish instead for plain payloads. Requires config.MQTTv5; otherwise the
+// properties are dropped and the payload is published as-is.
+func (m *MQTT) PublishWithProperties(topic string, payload []byte, qos byte, props MessageProperties) paho.Token {
+	if !m.mqttV5 {
+		logger.Warnf("PublishWithProperties called on %s without MQTTv5 enabled, publishing without properties", topic)
+		token := m.client.Publish(topic, qos, false, payload)
+		m.metrics.trackPublish(topic, token)
+		return token
+	}
+
+	body, err := json.Marshal(messageEnvelope{Properties: props, Payload: payload})
+	if err != nil {
+		logger.Errorf("unable to encode message properties for %s: %s", topic, err)
+		token := m.client.Publish(topic, qos, false, payload)
+		m.metrics.trackPublish(topic, token)
+		return token
+	}
+
+	token := m.client.Publish(topic, qos, false, append(append([]byte{}, v5Magic...), body...))
+	m.metrics.trackPublish(topic, token)
+	return token
+}
+
+// decodeEnvelope strips a PublishWithProperties envelope off payload, if present.
+func decodeEnvelope(payload []byte) ([]byte, MessageProperties) {
+	if !bytes.HasPrefix(payload, v5Magic) {
+		return payload, MessageProperties{}
+	}
+
+	var envelope messageEnvelope
+	if err := json.Unmarshal(payload[len(v5Magic):], &envelope); err != nil {
+		logger.Errorf("unable to decode message properties: %s", err)
+		return payload, MessageProperties{}
+	}
+
+	return envelope.Payload, envelope.Properties
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/underflow101/server/configuration"
+	"github.com/underflow101/server/sensorthings/models"
+)
+
+// storeAdapter bridges a models.MQTTStore to paho's Store interface.
+type storeAdapter struct {
+	store models.MQTTStore
+}
+
+func (s *storeAdapter) Open() {
+	s.store.Open()
+}
+
+func (s *storeAdapter) Put(key string, m packets.ControlPacket) {
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		logger.Errorf("unable to serialize packet %s for store: %s", key, err)
+		return
+	}
+	s.store.Put(key, buf.Bytes())
+}
+
+func (s *storeAdapter) Get(key string) packets.ControlPacket {
+	data := s.store.Get(key)
+	if data == nil {
+		return nil
+	}
+	packet, err := packets.ReadPacket(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		logger.Errorf("unable to deserialize stored packet %s: %s", key, err)
+		return nil
+	}
+	return packet
+}
+
+func (s *storeAdapter) All() []string {
+	return s.store.All()
+}
+
+func (s *storeAdapter) Del(key string) {
+	s.store.Del(key)
+}
+
+func (s *storeAdapter) Close() {
+	s.store.Close()
+}
+
+func (s *storeAdapter) Reset() {
+	s.store.Reset()
+}
+
+// resolveStore picks the paho.Store for config.StoreType ("memory", "file", or "custom").
+func resolveStore(config configuration.MQTTConfig, custom models.MQTTStore) paho.Store {
+	switch config.StoreType {
+	case "file":
+		dir := config.StoreDir
+		if dir == "" {
+			dir = "."
+		}
+		return paho.NewFileStore(dir)
+	case "custom":
+		if custom == nil {
+			logger.Errorf("MQTT store type \"custom\" selected without a models.MQTTStore implementation, falling back to memory store")
+			return paho.NewMemoryStore()
+		}
+		return &storeAdapter{store: custom}
+	default:
+		return paho.NewMemoryStore()
+	}
+}